@@ -1,31 +1,116 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"github.com/atuchak/redis-sentinel-proxy/resp"
 	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const ProxyDialTimeout = 50 * time.Millisecond
-const DialTimeout = 100 * time.Millisecond
+const DefaultProxyDialTimeout = 50 * time.Millisecond
+const DefaultDialTimeout = 100 * time.Millisecond
+const DefaultReadTimeout = 100 * time.Millisecond
+const DefaultWriteTimeout = 100 * time.Millisecond
 const SentryFlushTimeout = 5 * time.Second
+const SentinelPubSubMinBackoff = 100 * time.Millisecond
+const SentinelPubSubMaxBackoff = 30 * time.Second
+const ReplicaLatencyProbeInterval = 5 * time.Second
+const DefaultPoolTimeout = 3 * time.Second
+const DefaultIdleCheckFrequency = 1 * time.Minute
+const MetricsNamespace = "redis_sentinel_proxy"
+
+// Sentinel channels that mean "master topology may have changed, go re-resolve".
+var switchMasterChannels = []string{"+switch-master", "+sdown", "+odown", "+reset-master"}
 
 var (
-	log        = logrus.New()
+	log = logrus.New()
+
+	// masterLock guards masterAddr, which update_master writes and main's
+	// accept loop reads concurrently.
+	masterLock sync.Mutex
 	masterAddr *net.TCPAddr
 
 	localAddrAsStr    = flag.String("listen", ":9999", "local address")
-	sentinelAddrAsStr = flag.String("sentinel", ":26379", "remote address")
+	sentinelAddrAsStr = flag.String("sentinel", ":26379", "comma-separated list of sentinel seed addresses (host:port)")
 	masterNameAsStr   = flag.String("master", "", "name of the master redis node")
 	logLevelAsStr     = flag.String("log_level", "", "log level. Valid options are .")
+
+	sentinelUsernameAsStr = flag.String("sentinel-username", getEnvDefault("SENTINEL_USERNAME", ""), "username for sentinel AUTH")
+	sentinelPasswordAsStr = flag.String("sentinel-password", getEnvDefault("SENTINEL_PASSWORD", ""), "password for sentinel AUTH")
+	sentinelTLSEnabled    = flag.Bool("sentinel-tls", getEnvDefault("SENTINEL_TLS", "") != "", "connect to sentinels over TLS")
+	sentinelTLSCAFile     = flag.String("sentinel-tls-ca", getEnvDefault("SENTINEL_TLS_CA", ""), "path to a CA bundle used to verify sentinel certificates")
+	sentinelTLSCertFile   = flag.String("sentinel-tls-cert", getEnvDefault("SENTINEL_TLS_CERT", ""), "path to a client certificate for sentinel TLS")
+	sentinelTLSKeyFile    = flag.String("sentinel-tls-key", getEnvDefault("SENTINEL_TLS_KEY", ""), "path to the client certificate's key for sentinel TLS")
+
+	dialTimeoutAsDuration      = flag.Duration("dial-timeout", DefaultDialTimeout, "timeout for dialing a sentinel, and for the master liveness check and replica latency probes")
+	readTimeoutAsDuration      = flag.Duration("read-timeout", DefaultReadTimeout, "read timeout for sentinel connections")
+	writeTimeoutAsDuration     = flag.Duration("write-timeout", DefaultWriteTimeout, "write timeout for sentinel connections")
+	proxyDialTimeoutAsDuration = flag.Duration("proxy-dial-timeout", DefaultProxyDialTimeout, "timeout for dialing the master when proxying a client connection")
+
+	listenReplicaAddrAsStr = flag.String("listen-replica", "", "local address for read-replica routing; disabled when empty")
+	replicaSelectAsStr     = flag.String("replica-select", "round-robin", "replica selection strategy: round-robin or latency")
+
+	maxClientsAsInt              = flag.Int("max-clients", 0, "maximum concurrent proxied client sessions; 0 means unlimited")
+	poolTimeoutAsDuration        = flag.Duration("pool-timeout", DefaultPoolTimeout, "how long an accepted connection waits for a free pool slot before being rejected")
+	maxConnAgeAsDuration         = flag.Duration("max-conn-age", 0, "maximum lifetime of a proxied session before it's closed to allow rebalancing; 0 means unlimited")
+	idleTimeoutAsDuration        = flag.Duration("idle-timeout", 0, "close a proxied session after this much inactivity; 0 disables idle reaping")
+	idleCheckFrequencyAsDuration = flag.Duration("idle-check-frequency", DefaultIdleCheckFrequency, "how often the idle reaper scans sessions")
+	metricsAddrAsStr             = flag.String("metrics", "", "address to serve Prometheus pool metrics on; disabled when empty")
+
+	// slock guards knownSentinels and lastGoodSentinel, which are read/written
+	// from both the update_master goroutine and the sentinelUpdater goroutine.
+	slock            sync.Mutex
+	knownSentinels   []*net.TCPAddr
+	lastGoodSentinel *net.TCPAddr
+
+	// rlock guards replicaAddrs, replicaRTTs, and the current *replicaStopChan,
+	// read by every replica accept and written by update_master/refreshReplicas
+	// /replicaLatencyProber.
+	rlock            sync.Mutex
+	replicaAddrs     []*net.TCPAddr
+	replicaRTTs      map[string]time.Duration
+	replicaRRCounter uint64
+
+	// poolSem bounds concurrent proxied sessions; nil means unlimited.
+	poolSem      chan struct{}
+	poolWaiters  int64
+	poolTimeouts uint64
+
+	// sessionsLock guards sessions, the set of currently open proxied
+	// sessions used by the idle reaper and the pool metrics.
+	sessionsLock sync.Mutex
+	sessions     = map[*proxySession]struct{}{}
 )
 
+// currentMasterAddr returns the most recently resolved master address.
+func currentMasterAddr() *net.TCPAddr {
+	masterLock.Lock()
+	defer masterLock.Unlock()
+	return masterAddr
+}
+
+func getEnvDefault(key, fallback string) string {
+	if value, isPresent := os.LookupEnv(key); isPresent {
+		return value
+	}
+	return fallback
+}
+
 func parseLogLevel(levelAsStr string) logrus.Level {
 	for _, levelOption := range logrus.AllLevels {
 		if levelOption.String() == levelAsStr {
@@ -51,6 +136,10 @@ func checkArgs() {
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Failed to resolve local address '%s': %s", *localAddrAsStr, err))
 	}
+
+	if (*sentinelTLSCertFile == "") != (*sentinelTLSKeyFile == "") {
+		log.Fatal("sentinel-tls-cert and sentinel-tls-key must be set together.")
+	}
 }
 
 func getLocalListener() *net.TCPListener {
@@ -63,6 +152,41 @@ func getLocalListener() *net.TCPListener {
 	return listener
 }
 
+func getReplicaListener() *net.TCPListener {
+	laddr, _ := net.ResolveTCPAddr("tcp", *listenReplicaAddrAsStr)
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+	return listener
+}
+
+// acceptReplicas mirrors main's master accept loop, but picks a different
+// replica per connection instead of always proxying to the same address.
+func acceptReplicas(listener *net.TCPListener, replicaStopChan *chan string) {
+	for {
+		local, err := listener.AcceptTCP()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		replica := pickReplica()
+		if replica == nil {
+			log.Errorf("[REPLICA] No healthy replicas available, rejecting connection from %s", local.RemoteAddr().String())
+			local.Close()
+			continue
+		}
+
+		rlock.Lock()
+		stopChan := *replicaStopChan
+		rlock.Unlock()
+
+		go proxy(local, replica, stopChan)
+	}
+}
+
 func flushSentry() {
 	// Flush buffered events before the program terminates.
 	// Set the timeout to the maximum duration the program can afford to wait.
@@ -102,12 +226,29 @@ func main() {
 	setupLoggers()
 	checkArgs()
 
+	if *maxClientsAsInt > 0 {
+		poolSem = make(chan struct{}, *maxClientsAsInt)
+	}
+	go idleReaper()
+	startMetricsServer()
+
 	masterStopChan := make(chan string)
-	go update_master(&masterStopChan)
+	replicaStopChan := make(chan string)
+	resolveNow := make(chan struct{}, 1)
+	go sentinelUpdater(resolveNow)
+	go update_master(&masterStopChan, &replicaStopChan, resolveNow)
 
 	listener := getLocalListener()
 	defer listener.Close()
 
+	if *listenReplicaAddrAsStr != "" {
+		go replicaLatencyProber()
+
+		replicaListener := getReplicaListener()
+		defer replicaListener.Close()
+		go acceptReplicas(replicaListener, &replicaStopChan)
+	}
+
 	for {
 		local, err := listener.AcceptTCP()
 		if err != nil {
@@ -115,11 +256,16 @@ func main() {
 			continue
 		}
 
-		go proxy(local, masterAddr, masterStopChan)
+		go proxy(local, currentMasterAddr(), masterStopChan)
 	}
 }
 
-func update_master(masterStopChan *chan string) {
+// update_master keeps masterAddr current. Normally it just waits to be woken
+// by sentinelUpdater's +switch-master subscription, but it still polls on a
+// slow interval so a missed/never-established pub/sub connection can't wedge
+// master discovery forever. It also refreshes the replica rotation alongside
+// the master when -listen-replica is set.
+func update_master(masterStopChan *chan string, replicaStopChan *chan string, resolveNow <-chan struct{}) {
 	for {
 		possibleMaster, err := getMasterAddr(*sentinelAddrAsStr, *masterNameAsStr)
 		if err != nil {
@@ -128,34 +274,438 @@ func update_master(masterStopChan *chan string) {
 			continue
 		}
 
-		if possibleMaster.String() != masterAddr.String() {
-			log.Errorf("[MASTER] Master Address changed from %s to %s.", masterAddr.String(), possibleMaster.String())
+		oldMaster := currentMasterAddr()
+		if possibleMaster.String() != oldMaster.String() {
+			log.Errorf("[MASTER] Master Address changed from %s to %s.", oldMaster.String(), possibleMaster.String())
+			masterLock.Lock()
 			masterAddr = possibleMaster
+			masterLock.Unlock()
 			close(*masterStopChan)
 			*masterStopChan = make(chan string)
 		}
 
-		if masterAddr == nil {
+		if currentMasterAddr() == nil {
 			// if we haven't discovered master at all, then slow our roll as the cluster is
 			// probably still coming up
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
-		time.Sleep(250 * time.Millisecond)
+		if *listenReplicaAddrAsStr != "" {
+			refreshReplicas(replicaStopChan)
+		}
+
+		select {
+		case <-resolveNow:
+			// a +switch-master (or related) event came in over pub/sub; re-resolve right away
+		case <-time.After(5 * time.Second):
+			// fallback poll in case pub/sub is down or missed an event
+		}
+	}
+}
+
+// refreshReplicas re-resolves the replica list via the last-known-good
+// sentinel and, if it changed, closes *replicaStopChan so pooled replica
+// sessions rebalance onto the new set.
+func refreshReplicas(replicaStopChan *chan string) {
+	slock.Lock()
+	sentinel := lastGoodSentinel
+	slock.Unlock()
+	if sentinel == nil {
+		return
+	}
+
+	newReplicas, err := getReplicaAddrsFromSentinel(sentinel, *masterNameAsStr)
+	if err != nil {
+		log.Errorf("[REPLICA] Error refreshing replica list: %s.", err)
+		return
+	}
+
+	rlock.Lock()
+	changed := !sameTCPAddrs(replicaAddrs, newReplicas)
+	replicaAddrs = newReplicas
+	rlock.Unlock()
+
+	if changed {
+		log.Infof("[REPLICA] Replica list changed, now %v", newReplicas)
+		rlock.Lock()
+		close(*replicaStopChan)
+		*replicaStopChan = make(chan string)
+		rlock.Unlock()
+	}
+}
+
+func sameTCPAddrs(a, b []*net.TCPAddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := make(map[string]bool, len(a))
+	for _, addr := range a {
+		seen[addr.String()] = true
+	}
+	for _, addr := range b {
+		if !seen[addr.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// pickReplica selects a target for a new replica connection, either by
+// round-robin or, with -replica-select=latency, the replica with the lowest
+// last-measured dial RTT. Returns nil if no replicas are currently known.
+func pickReplica() *net.TCPAddr {
+	rlock.Lock()
+	defer rlock.Unlock()
+
+	if len(replicaAddrs) == 0 {
+		return nil
+	}
+
+	if *replicaSelectAsStr == "latency" {
+		var best *net.TCPAddr
+		var bestRTT time.Duration
+		for _, addr := range replicaAddrs {
+			rtt, known := replicaRTTs[addr.String()]
+			if !known {
+				continue
+			}
+			if best == nil || rtt < bestRTT {
+				best, bestRTT = addr, rtt
+			}
+		}
+		if best != nil {
+			return best
+		}
+		// No latency measurements yet; fall through to round-robin.
+	}
+
+	idx := atomic.AddUint64(&replicaRRCounter, 1)
+	return replicaAddrs[idx%uint64(len(replicaAddrs))]
+}
+
+// replicaLatencyProber periodically measures dial RTT to every known replica
+// so pickReplica can route by latency. It's a no-op unless -replica-select
+// is set to "latency".
+func replicaLatencyProber() {
+	if *replicaSelectAsStr != "latency" {
+		return
+	}
+
+	ticker := time.NewTicker(ReplicaLatencyProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rlock.Lock()
+		addrs := make([]*net.TCPAddr, len(replicaAddrs))
+		copy(addrs, replicaAddrs)
+		rlock.Unlock()
+
+		rtts := make(map[string]time.Duration, len(addrs))
+		for _, addr := range addrs {
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", addr.String(), *dialTimeoutAsDuration)
+			if err != nil {
+				continue
+			}
+			rtts[addr.String()] = time.Since(start)
+			conn.Close()
+		}
+
+		rlock.Lock()
+		replicaRTTs = rtts
+		rlock.Unlock()
+	}
+}
+
+// sentinelUpdater maintains a long-lived Pub/Sub subscription to a sentinel's
+// +switch-master/+sdown/+odown/+reset-master channels so update_master can
+// react immediately instead of waiting out a poll interval. It reconnects
+// with exponential backoff whenever the subscription drops.
+func sentinelUpdater(resolveNow chan<- struct{}) {
+	backoff := SentinelPubSubMinBackoff
+	for {
+		sentinel, err := pickSentinelForSubscribe()
+		if err != nil {
+			log.Errorf("[SENTINEL] Can't pick a sentinel to subscribe to: %s", err)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		if err := subscribeSwitchMaster(sentinel, resolveNow); err != nil {
+			log.Errorf("[SENTINEL] Pub/Sub connection to %s dropped: %s. Falling back to polling.", sentinel.String(), err)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		backoff = SentinelPubSubMinBackoff
+	}
+}
+
+func nextBackoff(current time.Duration) time.Duration {
+	next := current * 2
+	if next > SentinelPubSubMaxBackoff {
+		next = SentinelPubSubMaxBackoff
+	}
+	return next
+}
+
+// pickSentinelForSubscribe prefers the last-known-good sentinel (the one
+// master resolution is already succeeding against) and otherwise picks a
+// random known sentinel, lazily seeding knownSentinels if necessary.
+func pickSentinelForSubscribe() (*net.TCPAddr, error) {
+	slock.Lock()
+	defer slock.Unlock()
+
+	if len(knownSentinels) == 0 {
+		seeds, err := getSentinels(*sentinelAddrAsStr)
+		if err != nil {
+			return nil, err
+		}
+		knownSentinels = seeds
+	}
+
+	if lastGoodSentinel != nil {
+		return lastGoodSentinel, nil
+	}
+
+	return knownSentinels[rand.Intn(len(knownSentinels))], nil
+}
+
+// subscribeSwitchMaster opens a connection to sentinel, issues a raw RESP
+// SUBSCRIBE for the switch-master/sdown/odown/reset-master channels, and
+// signals resolveNow on every published "message" push received (subscribe
+// confirmations are ignored). It blocks until the
+// connection fails or is closed, at which point the caller reconnects.
+func subscribeSwitchMaster(sentinel *net.TCPAddr, resolveNow chan<- struct{}) error {
+	conn, err := dialSentinel(sentinel)
+	if err != nil {
+		return fmt.Errorf("can't dial sentinel: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(*writeTimeoutAsDuration))
+	if err := resp.WriteCommand(conn, append([]string{"SUBSCRIBE"}, switchMasterChannels...)...); err != nil {
+		return fmt.Errorf("can't send SUBSCRIBE: %s", err)
+	}
+
+	log.Infof("[SENTINEL] Subscribed to switch-master events on %s", sentinel.String())
+
+	// A subscription is long-lived by design, so unlike the other sentinel
+	// ops it isn't bounded by readTimeoutAsDuration between messages.
+	// dialSentinel clears any handshake/AUTH read deadline before returning,
+	// but clear it again here too so this loop is never at the mercy of a
+	// deadline set by some future dialSentinel change.
+	conn.SetReadDeadline(time.Time{})
+	reader := resp.NewReader(conn)
+	for {
+		value, err := reader.ReadValue()
+		if err != nil {
+			return fmt.Errorf("pub/sub read failed: %s", err)
+		}
+
+		fields, err := value.StringArray()
+		if err != nil || len(fields) < 2 || fields[0] != "message" {
+			continue
+		}
+
+		log.Infof("[SENTINEL] Received '%s' event from %s", fields[1], sentinel.String())
+		select {
+		case resolveNow <- struct{}{}:
+		default:
+			// a re-resolve is already pending
+		}
+	}
+}
+
+// proxySession tracks liveness of one proxied client<->master connection
+// pair so the idle reaper and the pool metrics can reason about it.
+type proxySession struct {
+	startedAt    time.Time
+	lastActivity int64 // unix nano, atomic
+	closeChan    chan struct{}
+}
+
+func newProxySession() *proxySession {
+	session := &proxySession{startedAt: time.Now(), closeChan: make(chan struct{})}
+	session.touch()
+	return session
+}
+
+func (s *proxySession) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *proxySession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+}
+
+func registerSession(s *proxySession) {
+	sessionsLock.Lock()
+	sessions[s] = struct{}{}
+	sessionsLock.Unlock()
+}
+
+func unregisterSession(s *proxySession) {
+	sessionsLock.Lock()
+	delete(sessions, s)
+	sessionsLock.Unlock()
+}
+
+// idleReaper closes any session that's had no traffic for longer than
+// -idle-timeout. It's a no-op when -idle-timeout is 0 (the default).
+func idleReaper() {
+	if *idleTimeoutAsDuration <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*idleCheckFrequencyAsDuration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sessionsLock.Lock()
+		for s := range sessions {
+			if s.idleFor() < *idleTimeoutAsDuration {
+				continue
+			}
+			select {
+			case <-s.closeChan:
+			default:
+				close(s.closeChan)
+			}
+		}
+		sessionsLock.Unlock()
+	}
+}
+
+// acquirePoolSlot blocks until a pool slot is free or -pool-timeout elapses.
+// It always succeeds when -max-clients is 0 (the default, unlimited).
+func acquirePoolSlot() bool {
+	if poolSem == nil {
+		return true
+	}
+
+	atomic.AddInt64(&poolWaiters, 1)
+	defer atomic.AddInt64(&poolWaiters, -1)
+
+	select {
+	case poolSem <- struct{}{}:
+		return true
+	case <-time.After(*poolTimeoutAsDuration):
+		atomic.AddUint64(&poolTimeouts, 1)
+		return false
 	}
 }
 
+func releasePoolSlot() {
+	if poolSem == nil {
+		return
+	}
+	<-poolSem
+}
+
+// startMetricsServer exposes pool stats (active, idle, waiters, timeouts)
+// as Prometheus gauges/counters on -metrics, so operators can size
+// -max-clients. It's a no-op when -metrics is empty (the default).
+func startMetricsServer() {
+	if *metricsAddrAsStr == "" {
+		return
+	}
+
+	active := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "pool",
+		Name:      "active_sessions",
+		Help:      "Number of proxied client sessions currently open.",
+	}, func() float64 {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		return float64(len(sessions))
+	})
+
+	idle := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "pool",
+		Name:      "idle_sessions",
+		Help:      "Number of proxied client sessions with no traffic in the last second.",
+	}, func() float64 {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+		idleCount := 0
+		for s := range sessions {
+			if s.idleFor() > time.Second {
+				idleCount++
+			}
+		}
+		return float64(idleCount)
+	})
+
+	waiters := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "pool",
+		Name:      "waiters",
+		Help:      "Number of accepted connections currently waiting for a free pool slot.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&poolWaiters))
+	})
+
+	timeouts := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "pool",
+		Name:      "timeouts_total",
+		Help:      "Number of accepted connections rejected because no pool slot freed up within -pool-timeout.",
+	}, func() float64 {
+		return float64(atomic.LoadUint64(&poolTimeouts))
+	})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(active, idle, waiters, timeouts)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		log.Errorf("[METRICS] Server on %s exited: %s", *metricsAddrAsStr, http.ListenAndServe(*metricsAddrAsStr, mux))
+	}()
+}
+
+// pipe copies r to w a chunk at a time (rather than io.Copy in one shot) so
+// it can touch session on every read and keep idle-reaping accurate.
 func pipe(
 	r net.Conn,
 	w net.Conn,
 	proxyChan chan<- string,
+	session *proxySession,
 ) {
-	bytes, err := io.Copy(w, r)
+	buf := make([]byte, 32*1024)
+	var total int64
+	var err error
+
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			session.touch()
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				err = writeErr
+				break
+			}
+			total += int64(n)
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+
 	if err != nil {
-		log.Errorf("[PROXY %s => %s] Shutting down stream; transferred %v bytes: %v\n", w.RemoteAddr().String(), r.RemoteAddr().String(), bytes, err)
+		log.Errorf("[PROXY %s => %s] Shutting down stream; transferred %v bytes: %v\n", w.RemoteAddr().String(), r.RemoteAddr().String(), total, err)
 	} else {
-		log.Infof("[PROXY %s => %s] Shutting down stream; transferred %v bytes: %v\n", w.RemoteAddr().String(), r.RemoteAddr().String(), bytes, err)
+		log.Infof("[PROXY %s => %s] Shutting down stream; transferred %v bytes\n", w.RemoteAddr().String(), r.RemoteAddr().String(), total)
 	}
 	close(proxyChan)
 }
@@ -165,7 +715,14 @@ func proxy(
 	remoteAddr *net.TCPAddr,
 	masterStopChan <-chan string,
 ) {
-	remote, err := net.DialTimeout("tcp4", remoteAddr.String(), ProxyDialTimeout)
+	if !acquirePoolSlot() {
+		log.Errorf("[PROXY] Pool timeout waiting for a free slot; rejecting connection from %s\n", local.RemoteAddr().String())
+		local.Close()
+		return
+	}
+	defer releasePoolSlot()
+
+	remote, err := net.DialTimeout("tcp4", remoteAddr.String(), *proxyDialTimeoutAsDuration)
 	if err != nil {
 		log.Infof("[PROXY %s => %s] Can't establish connection: %s\n", local.RemoteAddr().String(), remoteAddr.String(), err)
 		local.Close()
@@ -174,96 +731,413 @@ func proxy(
 	defer local.Close()
 	defer remote.Close()
 
+	session := newProxySession()
+	registerSession(session)
+	defer unregisterSession(session)
+
 	localChan := make(chan string)
 	remoteChan := make(chan string)
 
-	go pipe(local, remote, remoteChan)
-	go pipe(remote, local, localChan)
+	go pipe(local, remote, remoteChan, session)
+	go pipe(remote, local, localChan, session)
+
+	var maxConnAgeChan <-chan time.Time
+	if *maxConnAgeAsDuration > 0 {
+		timer := time.NewTimer(*maxConnAgeAsDuration)
+		defer timer.Stop()
+		maxConnAgeChan = timer.C
+	}
 
 	select {
 	case <-masterStopChan:
 	case <-localChan:
 	case <-remoteChan:
+	case <-maxConnAgeChan:
+		log.Infof("[PROXY %s => %s] Closing session: max-conn-age reached\n", local.RemoteAddr().String(), remoteAddr.String())
+	case <-session.closeChan:
+		log.Infof("[PROXY %s => %s] Closing session: reaped for inactivity\n", local.RemoteAddr().String(), remoteAddr.String())
 	}
 
 	log.Infof("[PROXY %s => %s] Closing connection\n", local.RemoteAddr().String(), remoteAddr.String())
 }
 
+// getSentinels expands a comma-separated list of sentinel seed addresses
+// (each itself possibly resolving to several IPs via DNS) into the full set
+// of candidate sentinel endpoints.
 func getSentinels(sentinelAddress string) (sentinelsWithPort []*net.TCPAddr, err error) {
-	sentinelHost, sentinelPort, err := net.SplitHostPort(sentinelAddress)
+	for _, seed := range strings.Split(sentinelAddress, ",") {
+		seed = strings.TrimSpace(seed)
+		if seed == "" {
+			continue
+		}
+
+		sentinelHost, sentinelPort, splitErr := net.SplitHostPort(seed)
+		if splitErr != nil {
+			log.Errorf("Can't find Sentinel: %s", splitErr)
+			err = fmt.Errorf("Can't find Sentinel: %s", splitErr)
+			continue
+		}
+
+		sentinels, lookupErr := net.LookupIP(sentinelHost)
+		if lookupErr != nil {
+			log.Errorf("Can't lookup Sentinel: %s", lookupErr)
+			err = fmt.Errorf("Can't lookup Sentinel: %s", lookupErr)
+			continue
+		}
+
+		for _, sentinelIP := range sentinels {
+			addr := net.JoinHostPort(sentinelIP.String(), sentinelPort)
+			log.Tracef("Sentinel address: %s", addr)
+			netAddr, resolveErr := net.ResolveTCPAddr("tcp", addr)
+			if resolveErr != nil {
+				log.Errorf("Can not resolve sentinel address: %s", addr)
+				continue
+			}
+			sentinelsWithPort = append(sentinelsWithPort, netAddr)
+		}
+	}
+
+	if len(sentinelsWithPort) == 0 {
+		if err == nil {
+			err = fmt.Errorf("No sentinel addresses could be resolved from '%s'", sentinelAddress)
+		}
+		return nil, err
+	}
+
+	// We found at least one usable sentinel, so don't fail the whole call
+	// just because one of several seeds couldn't be resolved.
+	return sentinelsWithPort, nil
+}
+
+// shuffledSentinels returns addrs in randomized order, with preferred moved
+// to the front when it's present. This spreads load across sentinels while
+// still trying the last-known-good one first.
+func shuffledSentinels(addrs []*net.TCPAddr, preferred *net.TCPAddr) []*net.TCPAddr {
+	shuffled := make([]*net.TCPAddr, len(addrs))
+	copy(shuffled, addrs)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	if preferred == nil {
+		return shuffled
+	}
+
+	for i, addr := range shuffled {
+		if addr.String() == preferred.String() {
+			shuffled[0], shuffled[i] = shuffled[i], shuffled[0]
+			break
+		}
+	}
+
+	return shuffled
+}
+
+// rememberSentinels merges newly discovered sentinel addresses (learned via
+// `SENTINEL sentinels <master>`) into the cached rotation, guarded by slock
+// since update_master and any sentinel updater goroutine share this slice.
+func rememberSentinels(addrs []*net.TCPAddr) {
+	if len(addrs) == 0 {
+		return
+	}
+
+	slock.Lock()
+	defer slock.Unlock()
+
+	for _, addr := range addrs {
+		known := false
+		for _, existing := range knownSentinels {
+			if existing.String() == addr.String() {
+				known = true
+				break
+			}
+		}
+		if !known {
+			log.Infof("Learned new sentinel: %s", addr.String())
+			knownSentinels = append(knownSentinels, addr)
+		}
+	}
+}
+
+// buildSentinelTLSConfig returns the tls.Config to use when dialing
+// sentinels, or nil if -sentinel-tls isn't set.
+func buildSentinelTLSConfig() (*tls.Config, error) {
+	if !*sentinelTLSEnabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if *sentinelTLSCAFile != "" {
+		caCert, err := ioutil.ReadFile(*sentinelTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read sentinel-tls-ca '%s': %s", *sentinelTLSCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("can't parse sentinel-tls-ca '%s'", *sentinelTLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if *sentinelTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*sentinelTLSCertFile, *sentinelTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load sentinel-tls-cert/sentinel-tls-key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// dialSentinel opens a connection to sentinelAddress, upgrading to TLS and
+// issuing AUTH when configured, so every sentinel call site shares the same
+// handshake instead of duplicating it.
+func dialSentinel(sentinelAddress *net.TCPAddr) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", sentinelAddress.String(), *dialTimeoutAsDuration)
 	if err != nil {
-		return nil, fmt.Errorf("Can't find Sentinel: %s", err)
+		return nil, fmt.Errorf("Sentinel did not respond: %s", sentinelAddress.String())
 	}
 
-	sentinels, err := net.LookupIP(sentinelHost)
+	tlsConfig, err := buildSentinelTLSConfig()
 	if err != nil {
-		return nil, fmt.Errorf("Can't lookup Sentinel: %s", err)
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = sentinelAddress.IP.String()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(*dialTimeoutAsDuration))
+		if err := tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			return nil, fmt.Errorf("sentinel TLS handshake with %s failed: %s", sentinelAddress.String(), err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
 	}
 
-	for _, sentinelIP := range sentinels {
-		addr := net.JoinHostPort(sentinelIP.String(), sentinelPort)
-		log.Tracef("Sentinel address: %s", addr)
-		netAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if *sentinelPasswordAsStr != "" {
+		authArgs := []string{"AUTH"}
+		if *sentinelUsernameAsStr != "" {
+			authArgs = append(authArgs, *sentinelUsernameAsStr)
+		}
+		authArgs = append(authArgs, *sentinelPasswordAsStr)
+
+		conn.SetWriteDeadline(time.Now().Add(*writeTimeoutAsDuration))
+		if err := resp.WriteCommand(conn, authArgs...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("can't send AUTH to sentinel %s: %s", sentinelAddress.String(), err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(*readTimeoutAsDuration))
+		reply, err := resp.NewReader(conn).ReadValue()
 		if err != nil {
-			log.Errorf("Can not resolve sentinel address: %s", addr)
+			conn.Close()
+			return nil, fmt.Errorf("can't read AUTH reply from sentinel %s: %s", sentinelAddress.String(), err)
 		}
-		sentinelsWithPort = append(sentinelsWithPort, netAddr)
+		if reply.Type == resp.Error {
+			conn.Close()
+			return nil, fmt.Errorf("sentinel %s rejected AUTH: %s", sentinelAddress.String(), reply.Str)
+		}
+		conn.SetReadDeadline(time.Time{})
 	}
 
-	return sentinelsWithPort, err
+	return conn, nil
 }
 
-func getMasterAddrFromSentinelResponse(response []byte) (*net.TCPAddr, error) {
-	responseParts := strings.Split(string(response), "\r\n")
-	if len(responseParts) < 5 {
-		log.Errorf("Wrong sentinel response: '%s'", response)
-		return nil, fmt.Errorf("Couldn't get update_master address from sentinel.")
+// sentinelArray issues a SENTINEL subcommand expected to reply with an array
+// of arrays (the field/value tuples sentinel uses for "sentinels"/"replicas"/
+// "slaves") and returns the outer array's elements.
+func sentinelArray(sentinelAddress *net.TCPAddr, args ...string) ([]*resp.Value, error) {
+	conn, err := dialSentinel(sentinelAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(*writeTimeoutAsDuration))
+	if err := resp.WriteCommand(conn, args...); err != nil {
+		return nil, fmt.Errorf("Can't write to sentinel: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(*readTimeoutAsDuration))
+	value, err := resp.NewReader(conn).ReadValue()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read from sentinel: %s", sentinelAddress.String())
+	}
+	if value.Type == resp.Error {
+		return nil, fmt.Errorf("Sentinel error: %s", value.Str)
+	}
+	if value.Type != resp.Array {
+		return nil, fmt.Errorf("Unexpected reply from %s: %s", sentinelAddress.String(), value)
+	}
+
+	return value.Array, nil
+}
+
+// getSentinelsFromSentinel asks sentinelAddress for the other sentinels it
+// knows about via `SENTINEL sentinels <name>`, so the rotation can grow
+// beyond the seeds passed on the command line.
+func getSentinelsFromSentinel(sentinelAddress *net.TCPAddr, masterName string) ([]*net.TCPAddr, error) {
+	entries, err := sentinelArray(sentinelAddress, "SENTINEL", "sentinels", masterName)
+	if err != nil {
+		return nil, err
+	}
+
+	var discovered []*net.TCPAddr
+	for _, entry := range entries {
+		fields, fieldsErr := entry.StringArray()
+		if fieldsErr != nil {
+			continue
+		}
+
+		var ip, port string
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "ip":
+				ip = fields[i+1]
+			case "port":
+				port = fields[i+1]
+			}
+		}
+		if ip == "" || port == "" {
+			continue
+		}
+
+		addr, resolveErr := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip, port))
+		if resolveErr != nil {
+			continue
+		}
+		discovered = append(discovered, addr)
+	}
+
+	return discovered, nil
+}
+
+// getReplicaAddrsFromSentinel lists the master's replicas via `SENTINEL
+// replicas <name>`, falling back to the older `SENTINEL slaves <name>` for
+// sentinels that predate that alias, and filters out any replica currently
+// flagged s_down/o_down/disconnected.
+func getReplicaAddrsFromSentinel(sentinelAddress *net.TCPAddr, masterName string) ([]*net.TCPAddr, error) {
+	entries, err := sentinelArray(sentinelAddress, "SENTINEL", "replicas", masterName)
+	if err != nil {
+		entries, err = sentinelArray(sentinelAddress, "SENTINEL", "slaves", masterName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var replicas []*net.TCPAddr
+	for _, entry := range entries {
+		fields, fieldsErr := entry.StringArray()
+		if fieldsErr != nil {
+			continue
+		}
+
+		var ip, port, replicaFlags string
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "ip":
+				ip = fields[i+1]
+			case "port":
+				port = fields[i+1]
+			case "flags":
+				replicaFlags = fields[i+1]
+			}
+		}
+		if ip == "" || port == "" {
+			continue
+		}
+		if strings.Contains(replicaFlags, "s_down") || strings.Contains(replicaFlags, "o_down") || strings.Contains(replicaFlags, "disconnected") {
+			continue
+		}
+
+		addr, resolveErr := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip, port))
+		if resolveErr != nil {
+			continue
+		}
+		replicas = append(replicas, addr)
+	}
+
+	return replicas, nil
+}
+
+func getMasterAddrFromSentinelResponse(value *resp.Value) (*net.TCPAddr, error) {
+	if value.Type == resp.Error {
+		return nil, fmt.Errorf("Sentinel error: %s", value.Str)
 	}
 
-	stringAddr := fmt.Sprintf("%s:%s", responseParts[2], responseParts[4])
+	addr, err := value.StringArray()
+	if err != nil || len(addr) < 2 {
+		log.Errorf("Wrong sentinel response: %s", value)
+		return nil, fmt.Errorf("Couldn't get update_master address from sentinel.")
+	}
 
-	return net.ResolveTCPAddr("tcp", stringAddr)
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(addr[0], addr[1]))
 }
 
 func getMasterAddrFromSentinel(sentinelAddress *net.TCPAddr) (*net.TCPAddr, error) {
-	conn, err := net.DialTimeout("tcp", sentinelAddress.String(), DialTimeout)
+	conn, err := dialSentinel(sentinelAddress)
 	if err != nil {
-		return nil, fmt.Errorf("Sentinel no not respond: %s", *sentinelAddrAsStr)
+		return nil, err
 	}
 	defer conn.Close()
 
-	conn.Write([]byte(fmt.Sprintf("sentinel get-master-addr-by-name %s\n", *masterNameAsStr)))
+	conn.SetWriteDeadline(time.Now().Add(*writeTimeoutAsDuration))
+	if err := resp.WriteCommand(conn, "SENTINEL", "get-master-addr-by-name", *masterNameAsStr); err != nil {
+		return nil, fmt.Errorf("Can't write to sentinel: %s", err)
+	}
 
-	b := make([]byte, 256)
-	_, err = conn.Read(b)
+	conn.SetReadDeadline(time.Now().Add(*readTimeoutAsDuration))
+	value, err := resp.NewReader(conn).ReadValue()
 	if err != nil {
-		log.Errorf("Cannot read from sentinel: %s", *sentinelAddrAsStr)
-		return nil, fmt.Errorf("Cannot read from sentinel: %s", *sentinelAddrAsStr)
+		log.Errorf("Cannot read from sentinel: %s", sentinelAddress.String())
+		return nil, fmt.Errorf("Cannot read from sentinel: %s", sentinelAddress.String())
 	}
-	return getMasterAddrFromSentinelResponse(b)
+	return getMasterAddrFromSentinelResponse(value)
 }
 
 func getMasterAddr(sentinelAddress string, masterName string) (*net.TCPAddr, error) {
-	sentinels, err := getSentinels(sentinelAddress)
-	if err != nil {
-		return nil, fmt.Errorf("Can't lookup Sentinel: %s", err)
+	slock.Lock()
+	if len(knownSentinels) == 0 {
+		seeds, err := getSentinels(sentinelAddress)
+		if err != nil {
+			slock.Unlock()
+			return nil, fmt.Errorf("Can't lookup Sentinel: %s", err)
+		}
+		knownSentinels = seeds
 	}
+	candidates := shuffledSentinels(knownSentinels, lastGoodSentinel)
+	slock.Unlock()
 
-	for _, sentinelAddress := range sentinels {
-
-		netMasterAddr, err := getMasterAddrFromSentinel(sentinelAddress)
+	for _, sentinel := range candidates {
+		netMasterAddr, err := getMasterAddrFromSentinel(sentinel)
 		if err != nil {
-			log.Errorf("Can not get master address from sentinel. %s", err)
+			// A single dead sentinel shouldn't stall discovery; move on quickly.
+			log.Errorf("Can not get master address from sentinel %s: %s", sentinel.String(), err)
+			continue
 		}
 
 		//check that there's actually someone listening on that address
-		conn2, err := net.DialTimeout("tcp", netMasterAddr.String(), DialTimeout)
+		conn2, err := net.DialTimeout("tcp", netMasterAddr.String(), *dialTimeoutAsDuration)
 		if err != nil {
 			log.Errorf("Can not dial master: %s", netMasterAddr.String())
 			continue
 		}
 		defer conn2.Close()
-		return netMasterAddr, err
+
+		slock.Lock()
+		lastGoodSentinel = sentinel
+		slock.Unlock()
+
+		if discovered, discoverErr := getSentinelsFromSentinel(sentinel, masterName); discoverErr == nil {
+			rememberSentinels(discovered)
+		}
+
+		return netMasterAddr, nil
 	}
 
 	// No available masters.
@@ -0,0 +1,165 @@
+// Package resp implements just enough of the RESP2 protocol (as spoken by
+// Redis and Sentinel) to send commands and read replies: simple strings,
+// errors, integers, bulk strings, and arrays of those. It replaces the
+// previous strings.Split-on-"\r\n" parsing, which broke on short reads,
+// IPv6 addresses containing colons, and non-standard sentinel replies.
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Type is the one-byte RESP type prefix.
+type Type byte
+
+const (
+	SimpleString Type = '+'
+	Error        Type = '-'
+	Integer      Type = ':'
+	BulkString   Type = '$'
+	Array        Type = '*'
+)
+
+// Value is a parsed RESP reply. Which fields are meaningful depends on Type:
+// SimpleString/Error/BulkString use Str, Integer uses Int, Array uses Array.
+// A nil bulk string or array (length -1) is represented with IsNil set.
+type Value struct {
+	Type  Type
+	Str   string
+	Int   int64
+	Array []*Value
+	IsNil bool
+}
+
+func (v *Value) String() string {
+	if v == nil {
+		return "<nil>"
+	}
+	switch v.Type {
+	case Array:
+		return fmt.Sprintf("Array(%d)", len(v.Array))
+	default:
+		return fmt.Sprintf("%c%s", v.Type, v.Str)
+	}
+}
+
+// StringArray returns an Array value's elements as strings. It errors if v
+// isn't an array, or if any element isn't a simple/bulk string.
+func (v *Value) StringArray() ([]string, error) {
+	if v.Type != Array {
+		return nil, fmt.Errorf("resp: not an array: %s", v)
+	}
+
+	out := make([]string, len(v.Array))
+	for i, item := range v.Array {
+		if item.Type != BulkString && item.Type != SimpleString {
+			return nil, fmt.Errorf("resp: array element %d is not a string: %s", i, item)
+		}
+		out[i] = item.Str
+	}
+	return out, nil
+}
+
+// Reader reads RESP values off a connection.
+type Reader struct {
+	br *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{br: bufio.NewReader(r)}
+}
+
+// ReadValue reads and parses a single RESP value, recursing into nested
+// arrays as needed.
+func (r *Reader) ReadValue() (*Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("resp: empty reply line")
+	}
+
+	switch Type(line[0]) {
+	case SimpleString:
+		return &Value{Type: SimpleString, Str: line[1:]}, nil
+
+	case Error:
+		return &Value{Type: Error, Str: line[1:]}, nil
+
+	case Integer:
+		i, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("resp: bad integer reply %q: %s", line, err)
+		}
+		return &Value{Type: Integer, Int: i}, nil
+
+	case BulkString:
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("resp: bad bulk string length %q: %s", line, err)
+		}
+		if n < 0 {
+			return &Value{Type: BulkString, IsNil: true}, nil
+		}
+
+		buf := make([]byte, n+2) // +2 for the trailing \r\n
+		if _, err := io.ReadFull(r.br, buf); err != nil {
+			return nil, fmt.Errorf("resp: short bulk string read: %s", err)
+		}
+		return &Value{Type: BulkString, Str: string(buf[:n])}, nil
+
+	case Array:
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("resp: bad array length %q: %s", line, err)
+		}
+		if n < 0 {
+			return &Value{Type: Array, IsNil: true}, nil
+		}
+
+		items := make([]*Value, n)
+		for i := range items {
+			items[i], err = r.ReadValue()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &Value{Type: Array, Array: items}, nil
+
+	default:
+		return nil, fmt.Errorf("resp: unknown reply type %q in line %q", line[0], line)
+	}
+}
+
+func (r *Reader) readLine() (string, error) {
+	line, err := r.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// WriteCommand writes args as a RESP array of bulk strings, the format
+// Redis/Sentinel expect commands in (e.g. *3\r\n$8\r\nSENTINEL\r\n...).
+func WriteCommand(w io.Writer, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,151 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadValueSimpleString(t *testing.T) {
+	r := NewReader(strings.NewReader("+OK\r\n"))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+	if v.Type != SimpleString || v.Str != "OK" {
+		t.Fatalf("got %+v, want SimpleString(OK)", v)
+	}
+}
+
+func TestReadValueError(t *testing.T) {
+	r := NewReader(strings.NewReader("-ERR unknown command\r\n"))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+	if v.Type != Error || v.Str != "ERR unknown command" {
+		t.Fatalf("got %+v, want Error(ERR unknown command)", v)
+	}
+}
+
+func TestReadValueInteger(t *testing.T) {
+	r := NewReader(strings.NewReader(":1000\r\n"))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+	if v.Type != Integer || v.Int != 1000 {
+		t.Fatalf("got %+v, want Integer(1000)", v)
+	}
+}
+
+func TestReadValueNilBulkString(t *testing.T) {
+	r := NewReader(strings.NewReader("$-1\r\n"))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+	if v.Type != BulkString || !v.IsNil {
+		t.Fatalf("got %+v, want nil BulkString", v)
+	}
+}
+
+func TestReadValueNilArray(t *testing.T) {
+	r := NewReader(strings.NewReader("*-1\r\n"))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+	if v.Type != Array || !v.IsNil {
+		t.Fatalf("got %+v, want nil Array", v)
+	}
+}
+
+// TestReadValueIPv6MasterAddr exercises the exact shape of a
+// get-master-addr-by-name reply for an IPv6 master, the case the old
+// strings.Split-on-colon parsing couldn't handle.
+func TestReadValueIPv6MasterAddr(t *testing.T) {
+	raw := "*2\r\n$39\r\n2001:0db8:85a3:0000:0000:8a2e:0370:7334\r\n$4\r\n6379\r\n"
+	r := NewReader(strings.NewReader(raw))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+
+	fields, err := v.StringArray()
+	if err != nil {
+		t.Fatalf("StringArray: %s", err)
+	}
+	if len(fields) != 2 || fields[0] != "2001:0db8:85a3:0000:0000:8a2e:0370:7334" || fields[1] != "6379" {
+		t.Fatalf("got %v, want [2001:0db8:85a3:0000:0000:8a2e:0370:7334 6379]", fields)
+	}
+}
+
+func TestReadValueNestedArray(t *testing.T) {
+	raw := "*2\r\n*2\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n*2\r\n$4\r\nport\r\n$4\r\n6379\r\n"
+	r := NewReader(strings.NewReader(raw))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+	if v.Type != Array || len(v.Array) != 2 {
+		t.Fatalf("got %+v, want outer Array(2)", v)
+	}
+
+	first, err := v.Array[0].StringArray()
+	if err != nil || len(first) != 2 || first[0] != "ip" || first[1] != "127.0.0.1" {
+		t.Fatalf("got %v, err %v, want [ip 127.0.0.1]", first, err)
+	}
+}
+
+func TestStringArrayRejectsNonArray(t *testing.T) {
+	v := &Value{Type: Integer, Int: 1}
+	if _, err := v.StringArray(); err == nil {
+		t.Fatal("StringArray on a non-array value should error")
+	}
+}
+
+func TestStringArrayRejectsNonStringElement(t *testing.T) {
+	v := &Value{Type: Array, Array: []*Value{
+		{Type: BulkString, Str: "ip"},
+		{Type: Integer, Int: 6379},
+	}}
+	if _, err := v.StringArray(); err == nil {
+		t.Fatal("StringArray with a non-string element should error")
+	}
+}
+
+// TestReadValueBulkStringSplitAcrossReads makes sure a bulk string whose
+// payload arrives in multiple TCP reads is still assembled correctly; this
+// is exactly the short-read case the old strings.Split parser broke on.
+func TestReadValueBulkStringSplitAcrossReads(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, chunk := range []string{"$5\r\nhe", "ll", "o\r\n"} {
+			pw.Write([]byte(chunk))
+		}
+		pw.Close()
+	}()
+
+	r := NewReader(pr)
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("ReadValue: %s", err)
+	}
+	if v.Type != BulkString || v.Str != "hello" {
+		t.Fatalf("got %+v, want BulkString(hello)", v)
+	}
+}
+
+func TestWriteCommand(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCommand(&buf, "SENTINEL", "get-master-addr-by-name", "mymaster"); err != nil {
+		t.Fatalf("WriteCommand: %s", err)
+	}
+
+	want := "*3\r\n$8\r\nSENTINEL\r\n$23\r\nget-master-addr-by-name\r\n$8\r\nmymaster\r\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}